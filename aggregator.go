@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var FlagPush = flag.String("push", "", "URL of a central Leucht instance to push the local load to")
+
+var FlagAgent = flag.Bool("agent", false, "Only push the load to -push instead of driving a lamp")
+
+var FlagSite = flag.String("site", "", "Site name reported to the central instance. Defaults to the hostname.")
+
+var FlagSiteWeights = flag.String("siteweights", "", "Weights of pushing sites, e.g. hq=2,berlin=1. Unlisted sites weigh 1.")
+
+var FlagSiteBlend = flag.String("siteblend", "max", "How to combine site loads: weighted, max or min")
+
+var FlagSiteTimeout = flag.Duration("sitetimeout", time.Minute, "Forget sites that have not pushed their load for this long")
+
+type siteLoad struct {
+	load uint
+	seen time.Time
+}
+
+// SiteAggregator collects the loads pushed by agents at several sites.
+type SiteAggregator struct {
+	sync.Mutex
+	sites map[string]siteLoad
+}
+
+// Sites receives pushed loads on /load and backs the "sites" source.
+var Sites = &SiteAggregator{sites: map[string]siteLoad{}}
+
+func (a *SiteAggregator) Report(site string, load uint) {
+	a.Lock()
+	a.sites[site] = siteLoad{load, time.Now()}
+	a.Unlock()
+}
+
+// Load combines the loads of all sites that reported within timeout.
+func (a *SiteAggregator) Load(weights []WeightedSource, blend string, timeout time.Duration) (uint, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	var sources []WeightedSource
+	var loads []uint
+
+	for site, sl := range a.sites {
+		if time.Since(sl.seen) > timeout {
+			delete(a.sites, site)
+			continue
+		}
+
+		source := WeightedSource{Name: site, Weight: 1}
+		for _, w := range weights {
+			if w.Name == site {
+				source.Weight = w.Weight
+			}
+		}
+
+		sources = append(sources, source)
+		loads = append(loads, sl.load)
+	}
+
+	return BlendLoads(sources, loads, blend)
+}
+
+func (a *SiteAggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	site := r.FormValue("site")
+	if site == "" {
+		http.Error(w, "missing site", http.StatusBadRequest)
+		return
+	}
+
+	load, err := strconv.ParseUint(r.FormValue("load"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid load: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.Report(site, uint(load))
+}
+
+func (c *LoadLoader) fetchLoadSites() uint {
+	load, err := Sites.Load(c.siteWeights, *FlagSiteBlend, *FlagSiteTimeout)
+	if err != nil {
+		log.Println("Error combining site loads:", err)
+		return 0
+	}
+
+	return load
+}
+
+func siteName() string {
+	if *FlagSite != "" {
+		return *FlagSite
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// PushLoad reports the local load to the central instance given by -push.
+// Pushes don't go through -sourceproxy but honor the proxy environment.
+func PushLoad(load uint) {
+	resp, err := http.PostForm(*FlagPush+"/load", url.Values{
+		"site": {siteName()},
+		"load": {fmt.Sprint(load)},
+	})
+	if err != nil {
+		log.Println("Error pushing load:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Println("Central instance rejected load:", resp.Status)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var FlagCalendar = flag.String("calendar", "", "File with holiday and special event color overlays")
+
+var FlagAlertLoad = flag.Uint("alertload", 90, "Load from which on calendar overlays are suppressed")
+
+// Overlay tints the load color on matching days. Calendar files have one
+// overlay per line:
+//
+//	12-24..12-26:    tint  #ff0000,#00ff00 0.2
+//	2026-11-02:      pulse #ffd700         0.6
+//	* 9-17 * * 5:    tint  #ff8800         0.1
+//
+// The part before the colon is a date (MM-DD or YYYY-MM-DD), an inclusive
+// date range or a cron expression (minute hour day month weekday). The
+// effect is "tint", which blends the palette colors into the load color,
+// or "pulse", which does so only every other interval. Palettes with
+// several colors cycle through them. The strength defaults to 0.2.
+type Overlay struct {
+	match    func(time.Time) bool
+	pulse    bool
+	palette  []RGB
+	strength float64
+}
+
+type Calendar []Overlay
+
+// Apply returns color with the first matching overlay applied. Overlays
+// never hide loads at or above -alertload.
+func (c Calendar) Apply(color RGB, load uint, now time.Time) RGB {
+	if load >= *FlagAlertLoad {
+		return color
+	}
+
+	for _, o := range c {
+		if !o.match(now) {
+			continue
+		}
+
+		interval := int64(*FlagInterval)
+		if interval == 0 {
+			interval = 1
+		}
+
+		tick := now.Unix() / interval
+		if o.pulse {
+			if tick%2 == 1 {
+				return color
+			}
+			// Only every other tick shows the palette.
+			tick /= 2
+		}
+
+		return BlendColor(color, o.palette[tick%int64(len(o.palette))], o.strength)
+	}
+
+	return color
+}
+
+// BlendColor mixes t into c, strength 0 being c and 1 being t.
+func BlendColor(c, t RGB, strength float64) RGB {
+	mix := func(a, b uint8) uint8 {
+		return uint8(float64(a)*(1-strength) + float64(b)*strength + 0.5)
+	}
+	return RGB{mix(c.R, t.R), mix(c.G, t.G), mix(c.B, t.B)}
+}
+
+func ParseCalendar(r io.Reader) (Calendar, error) {
+	var cal Calendar
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid calendar line %q", line)
+		}
+
+		overlay, err := parseOverlay(strings.TrimSpace(split[0]), strings.Fields(split[1]))
+		if err != nil {
+			return nil, fmt.Errorf("calendar line %q: %v", line, err)
+		}
+
+		cal = append(cal, overlay)
+	}
+
+	return cal, scanner.Err()
+}
+
+func parseOverlay(when string, effect []string) (Overlay, error) {
+	o := Overlay{strength: 0.2}
+
+	var err error
+	if len(strings.Fields(when)) == 5 {
+		o.match, err = parseCron(when)
+	} else {
+		o.match, err = parseDates(when)
+	}
+	if err != nil {
+		return o, err
+	}
+
+	if len(effect) < 2 || len(effect) > 3 {
+		return o, fmt.Errorf("expected effect, palette and optional strength")
+	}
+
+	switch effect[0] {
+	case "tint":
+	case "pulse":
+		o.pulse = true
+	default:
+		return o, fmt.Errorf("unknown effect %q", effect[0])
+	}
+
+	for _, s := range strings.Split(effect[1], ",") {
+		var c RGB
+		if _, err := fmt.Sscanf(s, "#%2x%2x%2x", &c.R, &c.G, &c.B); err != nil {
+			return o, fmt.Errorf("invalid color %q", s)
+		}
+		o.palette = append(o.palette, c)
+	}
+
+	if len(effect) == 3 {
+		if o.strength, err = strconv.ParseFloat(effect[2], 64); err != nil || o.strength < 0 || o.strength > 1 {
+			return o, fmt.Errorf("invalid strength %q", effect[2])
+		}
+	}
+
+	return o, nil
+}
+
+// parseDates parses MM-DD or YYYY-MM-DD dates and inclusive ranges of them
+// separated by "..". Ranges without year may wrap around new year.
+func parseDates(when string) (func(time.Time) bool, error) {
+	parse := func(s string) (year int, key int, err error) {
+		var month, day int
+		if strings.Count(s, "-") == 2 {
+			_, err = fmt.Sscanf(s, "%d-%d-%d", &year, &month, &day)
+		} else {
+			_, err = fmt.Sscanf(s, "%d-%d", &month, &day)
+		}
+		if err == nil && (month < 1 || month > 12 || day < 1 || day > 31) {
+			err = fmt.Errorf("invalid date %q", s)
+		}
+		return year, month*100 + day, err
+	}
+
+	bounds := strings.SplitN(when, "..", 2)
+	if len(bounds) == 1 {
+		bounds = append(bounds, bounds[0])
+	}
+
+	fromYear, from, err := parse(bounds[0])
+	if err != nil {
+		return nil, err
+	}
+	toYear, to, err := parse(bounds[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if (fromYear == 0) != (toYear == 0) {
+		return nil, fmt.Errorf("date range %q mixes dates with and without year", when)
+	}
+
+	return func(t time.Time) bool {
+		key := int(t.Month())*100 + t.Day()
+
+		if fromYear != 0 {
+			day := t.Year()*10000 + key
+			return day >= fromYear*10000+from && day <= toYear*10000+to
+		}
+
+		if from <= to {
+			return key >= from && key <= to
+		}
+		return key >= from || key <= to
+	}, nil
+}
+
+// parseCron parses the five cron fields minute, hour, day of month, month
+// and day of week. Fields can be "*", numbers, ranges "a-b", steps "*/n"
+// and comma separated lists of those.
+func parseCron(when string) (func(time.Time) bool, error) {
+	limits := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+	var fields [5]map[int]bool
+	for i, field := range strings.Fields(when) {
+		set, err := parseCronField(field, limits[i][0], limits[i][1])
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = set
+	}
+
+	return func(t time.Time) bool {
+		values := [5]int{t.Minute(), t.Hour(), t.Day(), int(t.Month()), int(t.Weekday())}
+		for i, value := range values {
+			if !fields[i][value] {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid cron step %q", part)
+			}
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid cron field %q", field)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid cron field %q", field)
+				}
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("cron field %q out of range %d-%d", field, min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+
+	return set, nil
+}
+
+func LoadCalendar(path string) Calendar {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	cal, err := ParseCalendar(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return cal
+}
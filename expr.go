@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"unicode"
+)
+
+// Expr is a parsed arithmetic expression over metric names such as
+// "cpu_user + cpu_system + 0.5*cpu_wio" or "100 - cpu_idle".
+type Expr interface {
+	Eval(metrics map[string]float64) (float64, error)
+}
+
+type numberExpr float64
+
+func (e numberExpr) Eval(map[string]float64) (float64, error) {
+	return float64(e), nil
+}
+
+type metricExpr string
+
+func (e metricExpr) Eval(metrics map[string]float64) (float64, error) {
+	v, ok := metrics[string(e)]
+	if !ok {
+		return 0, fmt.Errorf("missing metric %s", string(e))
+	}
+	return v, nil
+}
+
+type binaryExpr struct {
+	op          rune
+	left, right Expr
+}
+
+func (e binaryExpr) Eval(metrics map[string]float64) (float64, error) {
+	l, err := e.left.Eval(metrics)
+	if err != nil {
+		return 0, err
+	}
+	r, err := e.right.Eval(metrics)
+	if err != nil {
+		return 0, err
+	}
+
+	switch e.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	default:
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	}
+}
+
+type exprParser struct {
+	input []rune
+	pos   int
+}
+
+// ParseExpr parses expressions of numbers, metric names, + - * / and
+// parentheses with the usual precedence.
+func ParseExpr(s string) (Expr, error) {
+	p := &exprParser{input: []rune(s)}
+
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek() != 0 {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.peek(), p.pos)
+	}
+
+	return e, nil
+}
+
+func (p *exprParser) peek() rune {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+	if p.pos == len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *exprParser) sum() (Expr, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op, left, right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) product() (Expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op, left, right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) unary() (Expr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{'-', numberExpr(0), e}, nil
+	}
+	return p.operand()
+}
+
+func (p *exprParser) operand() (Expr, error) {
+	r := p.peek()
+	start := p.pos
+
+	switch {
+	case r == '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at position %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case unicode.IsDigit(r) || r == '.':
+		for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number at position %d: %v", start, err)
+		}
+		return numberExpr(v), nil
+	case unicode.IsLetter(r) || r == '_':
+		for p.pos < len(p.input) && (unicode.IsLetter(p.input[p.pos]) || unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '_') {
+			p.pos++
+		}
+		return metricExpr(p.input[start:p.pos]), nil
+	case r == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", r, p.pos)
+}
@@ -9,11 +9,13 @@ import (
 	_ "code.google.com/p/go-charset/data"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -25,6 +27,12 @@ var FlagInterval = flag.Uint("interval", 1, "In seconds when to fetch load.")
 
 var FlagGMonHost = flag.String("gmonhost", "localhost:8649", "Ganglia gmond host")
 
+var FlagSources = flag.String("sources", "gmond=1", "Load sources with weights, e.g. gmond=0.7,web=0.3")
+
+var FlagMetric = flag.String("metric", "cpu_user + cpu_system", "Expression over gmond metrics giving the load of a host, e.g. 100 - cpu_idle")
+
+var FlagBlend = flag.String("blend", "weighted", "How to blend source loads: weighted, max or min")
+
 type RGB struct {
 	R, G, B uint8
 }
@@ -33,10 +41,111 @@ func (c RGB) String() string {
 	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
 }
 
+// LoadSources maps source names usable in -sources to their fetch methods.
+var LoadSources = map[string]func(*LoadLoader) uint{
+	"gmond": (*LoadLoader).fetchLoadGanglia,
+	"web":   (*LoadLoader).fetchLoadWeb,
+	"sites": (*LoadLoader).fetchLoadSites,
+}
+
+type WeightedSource struct {
+	Name   string
+	Weight float64
+}
+
+// ParseWeights parses a list of weighted names like "gmond=0.7,web=0.3".
+// A missing weight defaults to 1.
+func ParseWeights(s string) ([]WeightedSource, error) {
+	var sources []WeightedSource
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		source := WeightedSource{Name: field, Weight: 1}
+
+		if i := strings.Index(field, "="); i >= 0 {
+			weight, err := strconv.ParseFloat(field[i+1:], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight for %q: %v", field[:i], err)
+			}
+			source.Name, source.Weight = field[:i], weight
+		}
+
+		if source.Weight < 0 {
+			return nil, fmt.Errorf("negative weight for %q", source.Name)
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// ParseSources parses the -sources list and checks that all sources exist.
+func ParseSources(s string) ([]WeightedSource, error) {
+	sources, err := ParseWeights(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, source := range sources {
+		if _, ok := LoadSources[source.Name]; !ok {
+			return nil, fmt.Errorf("unknown source %q", source.Name)
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no sources given")
+	}
+
+	return sources, nil
+}
+
+// BlendLoads combines the loads of several sources into one composite load.
+// "weighted" is the weighted average of all loads, "max" and "min" pick the
+// highest or lowest load of all sources with non-zero weight.
+func BlendLoads(sources []WeightedSource, loads []uint, blend string) (uint, error) {
+	switch blend {
+	case "weighted":
+		var sum, weights float64
+		for i, source := range sources {
+			sum += source.Weight * float64(loads[i])
+			weights += source.Weight
+		}
+		if weights == 0 {
+			return 0, nil
+		}
+		return uint(sum/weights + 0.5), nil
+	case "max", "min":
+		var result uint
+		first := true
+		for i, source := range sources {
+			if source.Weight == 0 {
+				continue
+			}
+			if first || (blend == "max" && loads[i] > result) || (blend == "min" && loads[i] < result) {
+				result = loads[i]
+				first = false
+			}
+		}
+		return result, nil
+	}
+	return 0, fmt.Errorf("unknown blend function %q", blend)
+}
+
 type LoadLoader struct {
 	sync.RWMutex
 	currentLoad uint
 	channels    []chan uint
+	sources     []WeightedSource
+	blend       string
+	metric      Expr
+	siteWeights []WeightedSource
+
+	skippedHosts map[string]bool
 }
 
 func (c *LoadLoader) LoadPeriodically(d time.Duration) {
@@ -78,11 +187,39 @@ func (c *LoadLoader) loader(d time.Duration) {
 }
 
 func (c *LoadLoader) fetchLoad() uint {
-	return c.fetchLoadGanglia()
+	var local []WeightedSource
+	var loads []uint
+	withSites := false
+
+	for _, source := range c.sources {
+		if source.Name == "sites" {
+			withSites = true
+			continue
+		}
+		local = append(local, source)
+		loads = append(loads, LoadSources[source.Name](c))
+	}
+
+	if len(local) > 0 {
+		load, err := BlendLoads(local, loads, c.blend)
+		if err != nil {
+			log.Println("Error blending loads:", err)
+			return 0
+		}
+
+		if !withSites {
+			return load
+		}
+
+		// The local load takes part in the site blend like any other site.
+		Sites.Report(siteName(), load)
+	}
+
+	return c.fetchLoadSites()
 }
 
 func (c *LoadLoader) fetchLoadGanglia() uint {
-	conn, err := net.Dial("tcp", *FlagGMonHost)
+	conn, err := SourceDialer.Dial("tcp", *FlagGMonHost)
 
 	if err != nil {
 		log.Println("Error connecting to ganglia:", err)
@@ -120,34 +257,75 @@ func (c *LoadLoader) fetchLoadGanglia() uint {
 		if strings.HasPrefix(host.Name, "yashik") {
 			numNodes++
 		}
+		metrics := map[string]float64{}
 		for _, metric := range host.Metrics {
-			switch metric.Name {
-			case "cpu_user":
-				fallthrough
-			case "cpu_system":
-				val, err := strconv.ParseFloat(metric.Value, 64)
-				if err != nil {
-					log.Println("Error while parsing", metric.Name, ":", err)
-					continue
+			// String metrics such as os_name can't take part in expressions.
+			if metric.Type == "string" {
+				continue
+			}
+			val, err := strconv.ParseFloat(metric.Value, 64)
+			if err != nil {
+				log.Println("Error while parsing", metric.Name, ":", err)
+				continue
+			}
+			metrics[metric.Name] = val
+		}
+
+		val, err := c.metric.Eval(metrics)
+		if err != nil {
+			// Hosts lacking a metric would log on every tick, so only
+			// report them once.
+			c.Lock()
+			if !c.skippedHosts[host.Name] {
+				log.Println("Skipping host", host.Name, "in metric evaluation:", err)
+				if c.skippedHosts == nil {
+					c.skippedHosts = map[string]bool{}
 				}
-				cpuUsage += val
+				c.skippedHosts[host.Name] = true
 			}
+			c.Unlock()
+			continue
+		}
+
+		c.Lock()
+		delete(c.skippedHosts, host.Name)
+		c.Unlock()
+
+		// Expressions like 100 - cpu_idle can dip below zero.
+		if val > 0 {
+			cpuUsage += val
 		}
 	}
 
+	if numNodes == 0 {
+		return 0
+	}
+
 	return uint(cpuUsage / float64(numNodes))
 }
 
 func (c *LoadLoader) fetchLoadWeb() uint {
-	doc, err := goquery.NewDocument(*FlagURL)
+	resp, err := SourceClient.Get(*FlagURL)
 
 	if err != nil {
 		log.Println("Error fetching ganglia page:", err)
 		return 0
 	}
 
+	doc, err := goquery.NewDocumentFromResponse(resp)
+
+	if err != nil {
+		log.Println("Error parsing ganglia page:", err)
+		return 0
+	}
+
 	selection := doc.Find("form > table").Eq(1).Find("table tr:nth-child(5) td b")
 	split := strings.Split(selection.Text(), ", ")
+	if len(split) < 3 {
+		log.Println("Error finding load in ganglia page:", selection.Text())
+		return 0
+	}
+
 	load, err := strconv.ParseUint(strings.Trim(split[2],"%"), 10, 32)
 
 	if err != nil {
@@ -185,7 +363,7 @@ func ColorFromLoad(load uint) RGB {
 }
 
 func FetchCurrentColor() (c RGB) {
-	resp, err := http.Get("http://alarmpi.local:1337/color")
+	resp, err := PiClient.Get(*FlagPiURL + "/color")
 	if err != nil {
 		return
 	}
@@ -199,52 +377,202 @@ func FetchCurrentColor() (c RGB) {
 }
 
 func SendColor(c RGB) {
-	url := fmt.Sprintf(*FlagPiURL+"/do?action=set&r=%d&g=%d&b=%d", c.R, c.G, c.B)
+	if LocalLUT != nil {
+		c = LocalLUT.Apply(c)
+	}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Println(err)
-		return
+	for _, command := range colorCommand(PiCaps, c) {
+		resp, err := PiClient.Get(*FlagPiURL + command)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		resp.Body.Close()
 	}
-	defer resp.Body.Close()
 }
 
-func FadeColor(from, to RGB) {
+// FadeStep moves from at most step closer to to on every channel.
+func FadeStep(from, to RGB, step uint8) RGB {
 	stepper := func(a, b uint8) uint8 {
 		if a < b {
-			return a + 1
+			if b-a < step {
+				return b
+			}
+			return a + step
 		} else if a > b {
-			return a - 1
+			if a-b < step {
+				return b
+			}
+			return a - step
 		} else {
 			return b
 		}
 	}
 
-	for from != to {
-		from.R = stepper(from.R, to.R)
-		from.G = stepper(from.G, to.G)
-		from.B = stepper(from.B, to.B)
+	from.R = stepper(from.R, to.R)
+	from.G = stepper(from.G, to.G)
+	from.B = stepper(from.B, to.B)
 
-		SendColor(from)
+	return from
+}
+
+// setupPi negotiates with the color server and returns the fader driving it.
+func setupPi() *Fader {
+	PiCaps = NegotiateCapabilities()
+	log.Printf("Color server capabilities: %+v", PiCaps)
+
+	if *FlagLUT != "" {
+		f, err := os.Open(*FlagLUT)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lut, err := ParseLUT(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		PushLUT(lut)
+	}
+
+	// With a local LUT the server shows calibrated colors, fade from the
+	// linear color they came from.
+	current := FetchCurrentColor()
+	if LocalLUT != nil {
+		current = LocalLUT.Invert(current)
 	}
+
+	return NewFader(SinkFunc(SendColor), current, SinkDelay(fadeStepDelay(PiCaps)))
 }
 
 func main() {
 	flag.Parse()
 
-	loadLoader := &LoadLoader{}
+	SetupProxies()
+
+	sources, err := ParseSources(*FlagSources)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := BlendLoads(sources, make([]uint, len(sources)), *FlagBlend); err != nil {
+		log.Fatal(err)
+	}
+
+	if *FlagMode != "current" && *FlagMode != "predict" {
+		log.Fatal("unknown mode ", *FlagMode)
+	}
+
+	metric, err := ParseExpr(*FlagMetric)
+	if err != nil {
+		log.Fatal("Error parsing metric expression: ", err)
+	}
+
+	siteWeights, err := ParseWeights(*FlagSiteWeights)
+	if err != nil {
+		log.Fatal("Error parsing site weights: ", err)
+	}
+
+	if _, err := BlendLoads(nil, nil, *FlagSiteBlend); err != nil {
+		log.Fatal(err)
+	}
+
+	if *FlagAgent && *FlagPush == "" {
+		log.Fatal("-agent needs -push")
+	}
+
+	loadLoader := &LoadLoader{sources: sources, blend: *FlagBlend, metric: metric, siteWeights: siteWeights}
 	loadLoader.LoadPeriodically(time.Duration(*FlagInterval) * time.Second)
 
-	currentColor := FetchCurrentColor()
+	if *FlagAgent {
+		for currentLoad := range loadLoader.Chan() {
+			fmt.Println("Current load:", currentLoad)
+			PushLoad(currentLoad)
+		}
+	}
+
+	override := NewOverride()
+	if *FlagListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/light", override)
+		mux.Handle("/load", Sites)
+
+		go func() {
+			log.Println("Listening on", *FlagListen)
+			log.Fatal(http.ListenAndServe(*FlagListen, mux))
+		}()
+	}
+
+	var faders []*Fader
+	for _, name := range strings.Split(*FlagSinks, ",") {
+		switch strings.TrimSpace(name) {
+		case "pi":
+			faders = append(faders, setupPi())
+		case "screen":
+			screen, err := NewScreenSink()
+			if err != nil {
+				log.Fatal(err)
+			}
 
-	for currentLoad := range loadLoader.Chan() {
-		loadColor := ColorFromLoad(currentLoad)
+			fader := NewFader(screen, RGB{0xFF, 0xFF, 0xFF}, SinkDelay(screenDelay))
 
-		fmt.Println("Current load:", currentLoad)
-		fmt.Println("Resulting color:", loadColor)
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-signals
+				fader.Stop()
+				screen.Reset()
+				os.Exit(0)
+			}()
 
-		FadeColor(currentColor, loadColor)
+			faders = append(faders, fader)
+		default:
+			log.Fatal("unknown sink ", name)
+		}
+	}
 
-		currentColor = loadColor
+	calendar := LoadCalendar(*FlagCalendar)
+	history := NewHistory(*FlagTrendWindow)
+	blink, warn := false, false
+
+	loadColor := ColorFromLoad(loadLoader.CurrentLoad())
+	loads := loadLoader.Chan()
+
+	for {
+		select {
+		case currentLoad := <-loads:
+			history.Add(time.Now(), currentLoad)
+
+			displayLoad := currentLoad
+			if *FlagMode == "predict" {
+				displayLoad, warn = PredictedLoad(history, currentLoad)
+				fmt.Println("Predicted load:", displayLoad)
+
+				// Blink by going dark every other interval.
+				blink = warn && !blink
+			}
+
+			loadColor = calendar.Apply(ColorFromLoad(displayLoad), displayLoad, time.Now())
+			if blink {
+				loadColor = RGB{}
+			}
+
+			fmt.Println("Current load:", currentLoad)
+			fmt.Println("Resulting color:", loadColor)
+
+			if *FlagPush != "" {
+				go PushLoad(currentLoad)
+			}
+		case <-override.Changed():
+		}
+
+		targetColor := override.Color(loadColor)
+		for _, fader := range faders {
+			// Fading would take longer than a blink lasts.
+			if warn {
+				fader.SetNow(targetColor)
+			} else {
+				fader.Set(targetColor)
+			}
+		}
 	}
 }
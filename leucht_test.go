@@ -1,7 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestColorFromLoad(t *testing.T) {
@@ -21,3 +29,461 @@ func TestColorFromLoad(t *testing.T) {
 		t.Fatal("HT load has not or negatively affected load.")
 	}
 }
+
+func TestBlendLoads(t *testing.T) {
+	sources, err := ParseSources("gmond=0.7,web=0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load, err := BlendLoads(sources, []uint{100, 0}, "weighted")
+	if err != nil || load != 70 {
+		t.Fatal("Weighted blend wrong:", load, err)
+	}
+
+	load, err = BlendLoads(sources, []uint{20, 80}, "max")
+	if err != nil || load != 80 {
+		t.Fatal("Max blend wrong:", load, err)
+	}
+
+	if _, err := ParseSources("nosuchsource=1"); err == nil {
+		t.Fatal("Unknown source accepted")
+	}
+}
+
+func TestColorCommand(t *testing.T) {
+	caps, err := ParseCapabilities("commands: set hsv\nchannels: 3\nmaxfade: 100\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !caps.Supports("hsv") || caps.MaxFade != 100 {
+		t.Fatal("Capabilities not parsed:", caps)
+	}
+
+	cmds := colorCommand(caps, RGB{0, 255, 0})
+	if len(cmds) != 1 || cmds[0] != "/do?action=hsv&h=120&s=255&v=255" {
+		t.Fatal("Unexpected HSV command:", cmds)
+	}
+
+	cmds = colorCommand(DefaultCapabilities, RGB{1, 2, 3})
+	if len(cmds) != 1 || cmds[0] != "/do?action=set&r=1&g=2&b=3" {
+		t.Fatal("Unexpected fallback command:", cmds)
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	cal, err := ParseCalendar(strings.NewReader(
+		"12-24..01-02: tint #ff0000 0.5\n" +
+			"0 12 * * 5: tint #00ff00 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blue := ColorFromLoad(0)
+
+	c := cal.Apply(blue, 0, time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC))
+	if c.R == 0 || c.B == 255 {
+		t.Fatal("Holiday tint not applied over new year:", c)
+	}
+
+	// 2026-10-16 is a friday.
+	c = cal.Apply(blue, 0, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	if c != (RGB{0, 255, 0}) {
+		t.Fatal("Cron overlay not applied:", c)
+	}
+
+	c = cal.Apply(blue, 0, time.Date(2026, 10, 16, 12, 1, 0, 0, time.UTC))
+	if c != blue {
+		t.Fatal("Overlay applied outside of cron schedule:", c)
+	}
+
+	pulse, err := ParseCalendar(strings.NewReader("01-01: pulse #ff0000,#00ff00 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[RGB]bool{}
+	for i := 0; i < 8; i++ {
+		seen[pulse.Apply(blue, 0, time.Date(2026, 1, 1, 0, 0, i, 0, time.UTC))] = true
+	}
+	if !seen[RGB{0xFF, 0, 0}] || !seen[RGB{0, 0xFF, 0}] || !seen[blue] {
+		t.Fatal("Pulse does not cycle through palette:", seen)
+	}
+
+	c = cal.Apply(ColorFromLoad(100), 100, time.Date(2026, 12, 24, 8, 0, 0, 0, time.UTC))
+	if c != ColorFromLoad(100) {
+		t.Fatal("Overlay hides alert load:", c)
+	}
+}
+
+func TestPredict(t *testing.T) {
+	h := NewHistory(time.Minute)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Load rising by one per second.
+	for i := 0; i < 120; i++ {
+		h.Add(start.Add(time.Duration(i)*time.Second), uint(i))
+	}
+
+	if len(h.samples) != 61 {
+		t.Fatal("History not trimmed to window:", len(h.samples))
+	}
+
+	load, ok := h.Predict(10 * time.Second)
+	if !ok || load != 129 {
+		t.Fatal("Unexpected prediction:", load, ok)
+	}
+}
+
+func TestParseExpr(t *testing.T) {
+	e, err := ParseExpr("cpu_user + cpu_system + 0.5*cpu_wio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := e.Eval(map[string]float64{"cpu_user": 10, "cpu_system": 5, "cpu_wio": 20})
+	if err != nil || v != 25 {
+		t.Fatal("Unexpected value:", v, err)
+	}
+
+	e, err = ParseExpr("100 - (cpu_idle)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.Eval(map[string]float64{}); err == nil {
+		t.Fatal("Missing metric not reported")
+	}
+
+	if _, err := ParseExpr("cpu_user +"); err == nil {
+		t.Fatal("Incomplete expression accepted")
+	}
+}
+
+func TestFaderCoalesces(t *testing.T) {
+	sent := make(chan RGB, 1024)
+	f := NewFader(SinkFunc(func(c RGB) { sent <- c }), RGB{}, 10*time.Millisecond)
+
+	f.Set(RGB{255, 0, 0})
+	f.Set(RGB{0, 0, 10})
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case c := <-sent:
+			if c.R > 1 {
+				t.Fatal("Superseded fade continued:", c)
+			}
+			if c == (RGB{0, 0, 10}) {
+				return
+			}
+		case <-deadline:
+			t.Fatal("Fader did not reach latest target")
+		}
+	}
+}
+
+func TestScreenGamma(t *testing.T) {
+	r, g, b := ScreenGamma(RGB{0xFF, 0xFF, 0xFF}, 0.2)
+	if r != 1 || g != 1 || b != 1 {
+		t.Fatal("White tints the screen:", r, g, b)
+	}
+
+	r, _, b = ScreenGamma(ColorFromLoad(0), 0.2)
+	if r >= b || r < 0.8 {
+		t.Fatal("Unexpected tint for idle cluster:", r, b)
+	}
+}
+
+func TestOverrideServeHTTP(t *testing.T) {
+	o := NewOverride()
+	o.Color(RGB{0, 0, 255})
+
+	post := func(body string) (int, LightState) {
+		rec := httptest.NewRecorder()
+		o.ServeHTTP(rec, httptest.NewRequest("POST", "/light", strings.NewReader(body)))
+
+		var state LightState
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, state
+	}
+
+	code, state := post(`{"state": "ON", "color": {"r": 0, "g": 255, "b": 0}}`)
+	if code != http.StatusOK || !state.Override || o.Color(RGB{0, 0, 255}) != (RGB{0, 255, 0}) {
+		t.Fatal("Color not overridden:", code, state)
+	}
+
+	code, state = post(`{"state": "OFF"}`)
+	if code != http.StatusOK || state.State != "OFF" || o.Color(RGB{0, 0, 255}) != (RGB{}) {
+		t.Fatal("Light not turned off:", code, state)
+	}
+
+	code, state = post(`{"state": "ON"}`)
+	if code != http.StatusOK || state.Override || o.Color(RGB{0, 0, 255}) != (RGB{0, 0, 255}) {
+		t.Fatal("Override not released:", code, state)
+	}
+
+	code, state = post(`{"brightness": 51}`)
+	if code != http.StatusOK || *state.Brightness != 51 || o.Color(RGB{0, 0, 255}) != (RGB{0, 0, 51}) {
+		t.Fatal("Brightness not applied:", code, state)
+	}
+
+	code, _ = post(`{"brightness": 10, "state": "bogus"}`)
+	if code != http.StatusBadRequest || o.Color(RGB{0, 0, 255}) != (RGB{0, 0, 51}) {
+		t.Fatal("Invalid state changed brightness:", code)
+	}
+}
+
+func TestParseLUT(t *testing.T) {
+	values := strings.Repeat(" 1", 256)
+
+	lut, err := ParseLUT(strings.NewReader("r:" + values + "\ng:" + values + "\nb:" + values + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := lut.Apply(RGB{10, 20, 30}); c != (RGB{1, 1, 1}) {
+		t.Fatal("LUT not applied:", c)
+	}
+
+	var gamma LUT
+	for channel := range gamma {
+		for i := range gamma[channel] {
+			gamma[channel][i] = uint8(i * i / 255)
+		}
+	}
+
+	c := RGB{200, 100, 0}
+	if inverted := gamma.Invert(gamma.Apply(c)); gamma.Apply(inverted) != gamma.Apply(c) {
+		t.Fatal("LUT not inverted:", inverted)
+	}
+
+	for _, invalid := range []string{
+		"r:" + values + "\ng:" + values + "\nb: 1 2 3\n",
+		"r:" + values + "\ng:" + values + "\nx:" + values + "\n",
+		"r:" + values + "\ng:" + values + "\n",
+	} {
+		if _, err := ParseLUT(strings.NewReader(invalid)); err == nil {
+			t.Fatal("Invalid LUT accepted:", invalid[len(invalid)-10:])
+		}
+	}
+}
+
+func TestSetupProxies(t *testing.T) {
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			fmt.Fprint(w, "proxied ", r.URL)
+			return
+		}
+
+		if r.Host != "gmond:8649" {
+			http.Error(w, "unexpected host "+r.Host, http.StatusBadGateway)
+			return
+		}
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		// Send the reply and gmond's data in one write.
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n<GANGLIA_XML>"))
+	}))
+	defer proxyServer.Close()
+
+	*FlagSourceProxy = proxyServer.URL
+	*FlagPiProxy = proxyServer.URL
+	defer func() {
+		*FlagSourceProxy = ""
+		*FlagPiProxy = ""
+		SetupProxies()
+	}()
+	SetupProxies()
+
+	conn, err := SourceDialer.Dial("tcp", "gmond:8649")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(data) != "<GANGLIA_XML>" {
+		t.Fatal("Data after CONNECT reply lost:", string(data), err)
+	}
+
+	resp, err := PiClient.Get("http://alarmpi.invalid/color")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "proxied http://alarmpi.invalid/color" {
+		t.Fatal("Pi request not proxied:", string(body))
+	}
+}
+
+func TestSiteAggregator(t *testing.T) {
+	a := &SiteAggregator{sites: map[string]siteLoad{}}
+
+	for _, body := range []string{"load=10", "site=berlin&load=high"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/load", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		a.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Fatal("Invalid push accepted:", body, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/load", strings.NewReader("site=berlin&load=40"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	a.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatal("Valid push rejected:", rec.Code)
+	}
+
+	a.Report("hq", 100)
+
+	weights, _ := ParseWeights("hq=3")
+	load, err := a.Load(weights, "weighted", time.Minute)
+	if err != nil || load != 85 {
+		t.Fatal("Unexpected weighted site load:", load, err)
+	}
+
+	a.sites["hq"] = siteLoad{100, time.Now().Add(-2 * time.Minute)}
+	load, err = a.Load(weights, "max", time.Minute)
+	if err != nil || load != 40 || len(a.sites) != 1 {
+		t.Fatal("Stale site not expired:", load, err)
+	}
+}
+
+func TestFaderStop(t *testing.T) {
+	sent := make(chan RGB, 1024)
+	f := NewFader(SinkFunc(func(c RGB) { sent <- c }), RGB{}, time.Millisecond)
+
+	f.Set(RGB{255, 255, 255})
+	<-sent
+	f.Stop()
+
+	n := len(sent)
+	time.Sleep(20 * time.Millisecond)
+	if len(sent) != n {
+		t.Fatal("Sink updated after stop")
+	}
+}
+
+func TestLocalLoadInSiteBlend(t *testing.T) {
+	LoadSources["test"] = func(*LoadLoader) uint { return 80 }
+	*FlagSite = "hq"
+	*FlagSiteBlend = "weighted"
+	defer func() {
+		delete(LoadSources, "test")
+		*FlagSite = ""
+		*FlagSiteBlend = "max"
+		Sites = &SiteAggregator{sites: map[string]siteLoad{}}
+	}()
+
+	Sites = &SiteAggregator{sites: map[string]siteLoad{}}
+	Sites.Report("berlin", 20)
+
+	sources, err := ParseSources("test,sites")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weights, _ := ParseWeights("hq=3")
+	c := &LoadLoader{sources: sources, blend: "weighted", siteWeights: weights}
+
+	if load := c.fetchLoad(); load != 65 {
+		t.Fatal("Local load not part of site blend:", load)
+	}
+}
+
+func TestFaderSetNow(t *testing.T) {
+	sent := make(chan RGB, 1024)
+	f := NewFader(SinkFunc(func(c RGB) { sent <- c }), RGB{242, 0, 13}, 100*time.Millisecond)
+
+	f.SetNow(RGB{})
+
+	select {
+	case c := <-sent:
+		if c != (RGB{}) {
+			t.Fatal("Sink not dark after first update:", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Sink never reached dark")
+	}
+}
+
+func TestFetchLoadGanglia(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, `<GANGLIA_XML><CLUSTER NAME="yashik">`+
+				`<HOST NAME="yashik1"><METRIC NAME="cpu_idle" VAL="105" TYPE="float"/></HOST>`+
+				`<HOST NAME="yashik2"><METRIC NAME="cpu_idle" VAL="50" TYPE="float"/></HOST>`+
+				`<HOST NAME="yashik3"></HOST>`+
+				`</CLUSTER></GANGLIA_XML>`)
+			conn.Close()
+		}
+	}()
+
+	host := *FlagGMonHost
+	*FlagGMonHost = listener.Addr().String()
+	defer func() { *FlagGMonHost = host }()
+
+	metric, err := ParseExpr("100 - cpu_idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &LoadLoader{metric: metric}
+
+	// yashik1 counts as idle rather than negative, yashik3 is skipped.
+	if load := c.fetchLoadGanglia(); load != 16 {
+		t.Fatal("Unexpected load:", load)
+	}
+
+	if !c.skippedHosts["yashik3"] || c.skippedHosts["yashik1"] {
+		t.Fatal("Host without metric not tracked:", c.skippedHosts)
+	}
+}
+
+func TestFaderRateLimitedFadeTime(t *testing.T) {
+	*FlagFadeTime = 500 * time.Millisecond
+	defer func() { *FlagFadeTime = 3 * time.Second }()
+
+	sent := make(chan RGB, 1024)
+	f := NewFader(SinkFunc(func(c RGB) { sent <- c }), ColorFromLoad(0), SinkDelay(50*time.Millisecond))
+
+	start := time.Now()
+	f.Set(ColorFromLoad(100))
+
+	deadline := time.After(750 * time.Millisecond)
+	for {
+		select {
+		case c := <-sent:
+			if c == ColorFromLoad(100) {
+				return
+			}
+		case <-deadline:
+			t.Fatal("Rate limited fade took too long:", time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var FlagLUT = flag.String("lut", "", "File with per-channel calibration lookup table to push to the color server")
+
+// LUT maps linear channel values to calibrated ones, one table per channel.
+// Its text form has one line per channel, e.g. "r: 0 1 1 2 ... 255" with
+// 256 values each.
+type LUT [3][256]uint8
+
+// LocalLUT is applied before sending colors if the color server cannot
+// take the lookup table itself.
+var LocalLUT *LUT
+
+func ParseLUT(r io.Reader) (*LUT, error) {
+	var lut LUT
+	seen := map[int]bool{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid LUT line %q", line)
+		}
+
+		channel := strings.Index("rgb", strings.TrimSpace(split[0]))
+		if channel < 0 || len(strings.TrimSpace(split[0])) != 1 {
+			return nil, fmt.Errorf("unknown LUT channel %q", split[0])
+		}
+
+		values := strings.Fields(split[1])
+		if len(values) != 256 {
+			return nil, fmt.Errorf("LUT channel %s has %d values, need 256", split[0], len(values))
+		}
+
+		for i, value := range values {
+			v, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid LUT value in channel %s: %v", split[0], err)
+			}
+			lut[channel][i] = uint8(v)
+		}
+		seen[channel] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(seen) != 3 {
+		return nil, fmt.Errorf("LUT needs r, g and b channels")
+	}
+
+	return &lut, nil
+}
+
+func (l *LUT) String() string {
+	var b strings.Builder
+	for channel, name := range []string{"r", "g", "b"} {
+		b.WriteString(name + ":")
+		for _, v := range l[channel] {
+			fmt.Fprintf(&b, " %d", v)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (l *LUT) Apply(c RGB) RGB {
+	return RGB{l[0][c.R], l[1][c.G], l[2][c.B]}
+}
+
+// Invert returns the linear color closest to mapping to the calibrated c.
+func (l *LUT) Invert(c RGB) RGB {
+	invert := func(channel int, v uint8) uint8 {
+		best, bestDiff := 0, 256
+		for i, mapped := range l[channel] {
+			diff := int(mapped) - int(v)
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff < bestDiff {
+				best, bestDiff = i, diff
+			}
+		}
+		return uint8(best)
+	}
+	return RGB{invert(0, c.R), invert(1, c.G), invert(2, c.B)}
+}
+
+// PushLUT uploads the lookup table to the color server. Servers without
+// the lut command get the table applied locally instead.
+func PushLUT(lut *LUT) {
+	if !PiCaps.Supports("lut") {
+		log.Println("Color server does not support lookup tables, calibrating locally")
+		LocalLUT = lut
+		return
+	}
+
+	resp, err := PiClient.Post(*FlagPiURL+"/lut", "text/plain", strings.NewReader(lut.String()))
+	if err != nil {
+		log.Println("Error pushing LUT, calibrating locally:", err)
+		LocalLUT = lut
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		log.Println("Color server rejected LUT, calibrating locally:", resp.Status, string(body))
+		LocalLUT = lut
+	}
+}
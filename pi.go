@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Capabilities describes what the color server supports. Servers announce
+// them at /capabilities as "key: value" lines, e.g.
+//
+//	commands: set hsv brightness
+//	channels: 3
+//	maxfade: 200
+//
+// where maxfade is the maximum number of fade steps per second.
+type Capabilities struct {
+	Commands map[string]bool
+	Channels int
+	MaxFade  uint
+}
+
+// DefaultCapabilities are assumed for servers without a capability handshake.
+var DefaultCapabilities = Capabilities{
+	Commands: map[string]bool{"set": true},
+	Channels: 3,
+}
+
+// PiCaps holds the negotiated capabilities of the color server.
+var PiCaps = DefaultCapabilities
+
+func (c Capabilities) Supports(command string) bool {
+	return c.Commands[command]
+}
+
+func ParseCapabilities(s string) (Capabilities, error) {
+	caps := Capabilities{Commands: map[string]bool{}, Channels: 3}
+
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			return caps, fmt.Errorf("invalid capability line %q", line)
+		}
+		key, value := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+
+		switch key {
+		case "commands":
+			for _, command := range strings.Fields(value) {
+				caps.Commands[command] = true
+			}
+		case "channels":
+			channels, err := strconv.Atoi(value)
+			if err != nil {
+				return caps, fmt.Errorf("invalid channel count: %v", err)
+			}
+			caps.Channels = channels
+		case "maxfade":
+			maxFade, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return caps, fmt.Errorf("invalid max fade rate: %v", err)
+			}
+			caps.MaxFade = uint(maxFade)
+		}
+	}
+
+	// Every server understands the basic set command.
+	caps.Commands["set"] = true
+
+	return caps, scanner.Err()
+}
+
+// NegotiateCapabilities asks the color server what it supports and falls
+// back to DefaultCapabilities if it does not know about the handshake.
+func NegotiateCapabilities() Capabilities {
+	resp, err := PiClient.Get(*FlagPiURL + "/capabilities")
+	if err != nil {
+		log.Println("Error fetching capabilities:", err)
+		return DefaultCapabilities
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return DefaultCapabilities
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Error reading capabilities:", err)
+		return DefaultCapabilities
+	}
+
+	caps, err := ParseCapabilities(string(body))
+	if err != nil {
+		log.Println("Error parsing capabilities:", err)
+		return DefaultCapabilities
+	}
+
+	// Colors and lookup tables are always sent as r, g and b.
+	if caps.Channels != 3 {
+		log.Println("Color server has", caps.Channels, "channels, only 3 are supported. Using default capabilities.")
+		return DefaultCapabilities
+	}
+
+	return caps
+}
+
+// HSV returns hue in degrees [0, 360) and saturation and value in [0, 255].
+func (c RGB) HSV() (h uint16, s, v uint8) {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	delta := max - min
+
+	var hue float64
+	switch {
+	case delta == 0:
+		hue = 0
+	case max == r:
+		hue = 60 * math.Mod((g-b)/delta, 6)
+	case max == g:
+		hue = 60 * ((b-r)/delta + 2)
+	default:
+		hue = 60 * ((r-g)/delta + 4)
+	}
+	if hue < 0 {
+		hue += 360
+	}
+
+	var sat float64
+	if max > 0 {
+		sat = delta / max
+	}
+
+	return uint16(hue+0.5) % 360, uint8(sat*255 + 0.5), uint8(max*255 + 0.5)
+}
+
+// colorCommand builds the request path for setting c using the richest
+// command the server supports.
+func colorCommand(caps Capabilities, c RGB) []string {
+	if caps.Supports("hsv") {
+		h, s, v := c.HSV()
+		return []string{fmt.Sprintf("/do?action=hsv&h=%d&s=%d&v=%d", h, s, v)}
+	}
+
+	if caps.Supports("brightness") {
+		// Send the color at full intensity and its brightness separately
+		// so the server can dim without losing color resolution.
+		max := c.R
+		if c.G > max {
+			max = c.G
+		}
+		if c.B > max {
+			max = c.B
+		}
+		full := c
+		if max > 0 {
+			full = RGB{
+				uint8(uint(c.R) * 255 / uint(max)),
+				uint8(uint(c.G) * 255 / uint(max)),
+				uint8(uint(c.B) * 255 / uint(max)),
+			}
+		}
+		return []string{
+			fmt.Sprintf("/do?action=set&r=%d&g=%d&b=%d", full.R, full.G, full.B),
+			fmt.Sprintf("/do?action=brightness&v=%d", max),
+		}
+	}
+
+	return []string{fmt.Sprintf("/do?action=set&r=%d&g=%d&b=%d", c.R, c.G, c.B)}
+}
+
+// fadeStepDelay is the pause between fade steps the server can keep up with.
+func fadeStepDelay(caps Capabilities) time.Duration {
+	if caps.MaxFade == 0 {
+		return 0
+	}
+	return time.Second / time.Duration(caps.MaxFade)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+var FlagSourceProxy = flag.String("sourceproxy", "", "Proxy URL (http://, https:// or socks5://) for monitoring source requests. Defaults to the environment.")
+
+var FlagPiProxy = flag.String("piproxy", "", "Proxy URL (http://, https:// or socks5://) for color server requests. Defaults to the environment.")
+
+// SourceClient and PiClient are used for all HTTP requests to the monitoring
+// sources and the color server respectively. Without explicit proxy flags
+// they honor HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+var SourceClient = http.DefaultClient
+
+var PiClient = http.DefaultClient
+
+// SourceDialer is used for raw TCP connections to gmond. Without an explicit
+// proxy it honors ALL_PROXY and NO_PROXY.
+var SourceDialer proxy.Dialer = proxy.Direct
+
+func init() {
+	dialer := func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+		return &connectDialer{proxy: u, forward: forward}, nil
+	}
+	proxy.RegisterDialerType("http", dialer)
+	proxy.RegisterDialerType("https", dialer)
+}
+
+// connectDialer tunnels TCP connections through an HTTP proxy with CONNECT.
+// Proxies with the https scheme are talked to over TLS.
+type connectDialer struct {
+	proxy   *url.URL
+	forward proxy.Dialer
+}
+
+// bufferedConn reads what was buffered while reading the CONNECT reply
+// before reading from the connection itself.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (d *connectDialer) Dial(network, addr string) (net.Conn, error) {
+	host := d.proxy.Host
+	if d.proxy.Port() == "" {
+		port := "80"
+		if d.proxy.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(d.proxy.Hostname(), port)
+	}
+
+	conn, err := d.forward.Dial(network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+
+	// gmond talks first, so its data may already be buffered.
+	return &bufferedConn{conn, br}, nil
+}
+
+func proxyClient(proxyURL string) (*http.Client, error) {
+	if proxyURL == "" {
+		return http.DefaultClient, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", proxyURL, err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// SetupProxies configures the clients and dialers from the proxy flags.
+func SetupProxies() {
+	var err error
+
+	if SourceClient, err = proxyClient(*FlagSourceProxy); err != nil {
+		log.Fatal(err)
+	}
+
+	if PiClient, err = proxyClient(*FlagPiProxy); err != nil {
+		log.Fatal(err)
+	}
+
+	if *FlagSourceProxy == "" {
+		SourceDialer = proxy.FromEnvironment()
+		return
+	}
+
+	u, err := url.Parse(*FlagSourceProxy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if SourceDialer, err = proxy.FromURL(u, proxy.Direct); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var FlagScreenOutput = flag.String("screenoutput", "", "xrandr outputs to tint, e.g. DP-1,HDMI-1. Defaults to all connected outputs.")
+
+var FlagScreenStrength = flag.Float64("screenstrength", 0.15, "How strongly the screen is tinted, from 0 to 1")
+
+var FlagScreenCmd = flag.String("screencmd", "", "Command setting the screen gamma instead of xrandr, e.g. for Wayland. {r}, {g} and {b} are replaced by the gamma factors.")
+
+// screenDelay keeps the fade from spawning more processes than necessary.
+const screenDelay = 100 * time.Millisecond
+
+// ScreenSink tints the monitor by adjusting its gamma, for those without a
+// physical lamp.
+type ScreenSink struct {
+	outputs []string
+}
+
+func NewScreenSink() (*ScreenSink, error) {
+	if *FlagScreenStrength < 0 || *FlagScreenStrength > 1 {
+		return nil, fmt.Errorf("-screenstrength must be between 0 and 1, got %v", *FlagScreenStrength)
+	}
+
+	s := &ScreenSink{}
+
+	if *FlagScreenCmd != "" {
+		return s, nil
+	}
+
+	if *FlagScreenOutput != "" {
+		s.outputs = strings.Split(*FlagScreenOutput, ",")
+		return s, nil
+	}
+
+	out, err := exec.Command("xrandr", "--query").Output()
+	if err != nil {
+		return nil, fmt.Errorf("querying xrandr outputs: %v", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == "connected" {
+			s.outputs = append(s.outputs, fields[0])
+		}
+	}
+
+	if len(s.outputs) == 0 {
+		return nil, fmt.Errorf("no connected xrandr outputs found")
+	}
+
+	return s, nil
+}
+
+// ScreenGamma maps c to per channel gamma factors that stay close to 1 so
+// the screen remains usable.
+func ScreenGamma(c RGB, strength float64) (r, g, b float64) {
+	factor := func(v uint8) float64 {
+		return 1 - strength*(1-float64(v)/255)
+	}
+	return factor(c.R), factor(c.G), factor(c.B)
+}
+
+func (s *ScreenSink) SendColor(c RGB) {
+	r, g, b := ScreenGamma(c, *FlagScreenStrength)
+	s.setGamma(r, g, b)
+}
+
+// Reset restores the untinted gamma.
+func (s *ScreenSink) Reset() {
+	s.setGamma(1, 1, 1)
+}
+
+func (s *ScreenSink) setGamma(r, g, b float64) {
+	if *FlagScreenCmd != "" {
+		cmd := strings.NewReplacer(
+			"{r}", fmt.Sprintf("%.3f", r),
+			"{g}", fmt.Sprintf("%.3f", g),
+			"{b}", fmt.Sprintf("%.3f", b),
+		).Replace(*FlagScreenCmd)
+
+		if out, err := exec.Command("sh", "-c", cmd).CombinedOutput(); err != nil {
+			log.Println("Error setting screen gamma:", err, string(out))
+		}
+		return
+	}
+
+	gamma := fmt.Sprintf("%.3f:%.3f:%.3f", r, g, b)
+	for _, output := range s.outputs {
+		if out, err := exec.Command("xrandr", "--output", output, "--gamma", gamma).CombinedOutput(); err != nil {
+			log.Println("Error setting gamma of", output, ":", err, string(out))
+		}
+	}
+}
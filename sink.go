@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var FlagSinks = flag.String("sinks", "pi", "Comma separated sinks to display the load on: pi, screen")
+
+var FlagMaxRate = flag.Float64("maxrate", 0, "Maximum color updates per second sent to each sink. Unlimited if 0.")
+
+var FlagFadeTime = flag.Duration("fadetime", 3*time.Second, "Longest time a fade may take on rate limited sinks")
+
+// Sink displays colors, e.g. the lamp behind the color server.
+type Sink interface {
+	SendColor(c RGB)
+}
+
+type SinkFunc func(c RGB)
+
+func (f SinkFunc) SendColor(c RGB) {
+	f(c)
+}
+
+// SinkDelay is the minimum pause between two updates of a sink, the
+// larger of the sink's own limit and -maxrate.
+func SinkDelay(sinkDelay time.Duration) time.Duration {
+	if *FlagMaxRate > 0 {
+		if d := time.Duration(float64(time.Second) / *FlagMaxRate); d > sinkDelay {
+			return d
+		}
+	}
+	return sinkDelay
+}
+
+// Fader fades a sink towards the latest target color. Targets set while a
+// fade is running replace it, so bursts of updates coalesce into one fade
+// to the newest color instead of queueing up. Rate limited sinks fade in
+// larger steps so a fade never takes longer than -fadetime.
+type Fader struct {
+	sync.Mutex
+	sink    Sink
+	current RGB
+	delay   time.Duration
+	step    uint8
+	target  chan fadeTarget
+
+	// sending is held while the sink is updated.
+	sending sync.Mutex
+	stopped bool
+}
+
+func NewFader(sink Sink, current RGB, delay time.Duration) *Fader {
+	f := &Fader{
+		sink:    sink,
+		current: current,
+		delay:   delay,
+		step:    1,
+		target:  make(chan fadeTarget, 1),
+	}
+
+	// A full fade takes 255 steps.
+	if delay > 0 && *FlagFadeTime > 0 {
+		steps := int64(*FlagFadeTime / delay)
+		if steps < 1 {
+			steps = 1
+		}
+		if step := (255 + steps - 1) / steps; step > 1 {
+			f.step = uint8(step)
+		}
+	}
+	go f.run()
+	return f
+}
+
+type fadeTarget struct {
+	color RGB
+	jump  bool
+}
+
+// Set makes c the new target color without waiting for the fade.
+func (f *Fader) Set(c RGB) {
+	f.set(fadeTarget{c, false})
+}
+
+// SetNow shows c with the next update instead of fading to it.
+func (f *Fader) SetNow(c RGB) {
+	f.set(fadeTarget{c, true})
+}
+
+func (f *Fader) set(t fadeTarget) {
+	f.Lock()
+	defer f.Unlock()
+
+	// Drop a target the fader has not picked up yet.
+	select {
+	case <-f.target:
+	default:
+	}
+	f.target <- t
+}
+
+func (f *Fader) run() {
+	target := <-f.target
+	var last time.Time
+
+	for {
+		if f.current == target.color {
+			target = <-f.target
+			continue
+		}
+
+		select {
+		case target = <-f.target:
+		default:
+		}
+
+		if wait := f.delay - time.Since(last); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		f.sending.Lock()
+		if f.stopped {
+			f.sending.Unlock()
+			return
+		}
+		if target.jump {
+			f.current = target.color
+		} else {
+			f.current = FadeStep(f.current, target.color, f.step)
+		}
+		f.sink.SendColor(f.current)
+		f.sending.Unlock()
+
+		last = time.Now()
+	}
+}
+
+// Stop ends fading. Once it returns the sink won't be updated anymore.
+func (f *Fader) Stop() {
+	f.sending.Lock()
+	f.stopped = true
+	f.sending.Unlock()
+}
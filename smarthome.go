@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var FlagListen = flag.String("listen", "", "Address for the smart home light endpoint, e.g. :8080. Disabled if empty.")
+
+// Override takes precedence over the load color when active. Turning the
+// light off or setting a color activates it, turning it on without a color
+// hands control back to the load.
+type Override struct {
+	sync.RWMutex
+	active     bool
+	color      RGB
+	brightness uint8
+	loadColor  RGB
+	changed    chan struct{}
+}
+
+func NewOverride() *Override {
+	return &Override{brightness: 255, changed: make(chan struct{}, 1)}
+}
+
+// Changed yields whenever the override was modified.
+func (o *Override) Changed() <-chan struct{} {
+	return o.changed
+}
+
+func (o *Override) notify() {
+	select {
+	case o.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Override) Set(c RGB) {
+	o.Lock()
+	o.active = true
+	o.color = c
+	o.Unlock()
+	o.notify()
+}
+
+func (o *Override) SetBrightness(b uint8) {
+	o.Lock()
+	o.brightness = b
+	o.Unlock()
+	o.notify()
+}
+
+func (o *Override) Release() {
+	o.Lock()
+	o.active = false
+	o.Unlock()
+	o.notify()
+}
+
+// Color returns the color to display given the color derived from load.
+func (o *Override) Color(loadColor RGB) RGB {
+	o.Lock()
+	defer o.Unlock()
+
+	o.loadColor = loadColor
+	return o.colorLocked()
+}
+
+func (o *Override) colorLocked() RGB {
+	c := o.loadColor
+	if o.active {
+		c = o.color
+	}
+
+	return RGB{
+		uint8(uint(c.R) * uint(o.brightness) / 255),
+		uint8(uint(c.G) * uint(o.brightness) / 255),
+		uint8(uint(c.B) * uint(o.brightness) / 255),
+	}
+}
+
+type lightColor struct {
+	R uint8 `json:"r"`
+	G uint8 `json:"g"`
+	B uint8 `json:"b"`
+}
+
+// LightState follows the JSON schema of Home Assistant lights, which
+// simple voice assistant skills can forward to as well.
+type LightState struct {
+	State      string      `json:"state"`
+	Color      *lightColor `json:"color,omitempty"`
+	Brightness *uint8      `json:"brightness,omitempty"`
+	Override   bool        `json:"override"`
+}
+
+func (o *Override) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		var state LightState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch strings.ToUpper(state.State) {
+		case "OFF", "ON", "":
+		default:
+			http.Error(w, "unknown state "+state.State, http.StatusBadRequest)
+			return
+		}
+
+		if state.Brightness != nil {
+			o.SetBrightness(*state.Brightness)
+		}
+
+		switch strings.ToUpper(state.State) {
+		case "OFF":
+			o.Set(RGB{})
+		case "ON":
+			if state.Color != nil {
+				o.Set(RGB{state.Color.R, state.Color.G, state.Color.B})
+			} else {
+				o.Release()
+			}
+		case "":
+			if state.Color != nil {
+				o.Set(RGB{state.Color.R, state.Color.G, state.Color.B})
+			}
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Copy the state so slow clients don't block the main loop.
+	o.RLock()
+	c := o.colorLocked()
+	brightness := o.brightness
+	state := LightState{
+		State:      "ON",
+		Color:      &lightColor{c.R, c.G, c.B},
+		Brightness: &brightness,
+		Override:   o.active,
+	}
+	if o.active && o.color == (RGB{}) {
+		state.State = "OFF"
+	}
+	o.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		log.Println("Error writing light state:", err)
+	}
+}
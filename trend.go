@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var FlagMode = flag.String("mode", "current", "Display the current load or the load predicted by the recent trend (predict)")
+
+var FlagTrendWindow = flag.Duration("trendwindow", 5*time.Minute, "How much load history the trend is fitted over")
+
+var FlagHorizon = flag.Duration("horizon", 3*time.Minute, "How far ahead to predict the load in predict mode")
+
+type loadSample struct {
+	at   time.Time
+	load float64
+}
+
+// History keeps the loads seen within a time window to fit a trend over.
+type History struct {
+	window  time.Duration
+	samples []loadSample
+}
+
+func NewHistory(window time.Duration) *History {
+	return &History{window: window}
+}
+
+func (h *History) Add(at time.Time, load uint) {
+	h.samples = append(h.samples, loadSample{at, float64(load)})
+
+	i := 0
+	for i < len(h.samples) && at.Sub(h.samples[i].at) > h.window {
+		i++
+	}
+	h.samples = h.samples[i:]
+}
+
+// Predict fits a line through the history by least squares and returns the
+// load it predicts horizon after the latest sample. It returns false if
+// there are not enough samples for a trend.
+func (h *History) Predict(horizon time.Duration) (uint, bool) {
+	if len(h.samples) < 2 {
+		return 0, false
+	}
+
+	latest := h.samples[len(h.samples)-1].at
+
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range h.samples {
+		x := s.at.Sub(latest).Seconds()
+		sumX += x
+		sumY += s.load
+		sumXY += x * s.load
+		sumXX += x * x
+	}
+
+	n := float64(len(h.samples))
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0, false
+	}
+
+	slope := (n*sumXY - sumX*sumY) / denom
+	intercept := (sumY - slope*sumX) / n
+
+	predicted := intercept + slope*horizon.Seconds()
+	if predicted < 0 {
+		predicted = 0
+	}
+
+	return uint(predicted + 0.5), true
+}
+
+// PredictedLoad returns the load to display in predict mode and whether
+// the lamp should blink because the alert load will be crossed soon.
+func PredictedLoad(h *History, current uint) (uint, bool) {
+	predicted, ok := h.Predict(*FlagHorizon)
+	if !ok {
+		return current, false
+	}
+
+	return predicted, current < *FlagAlertLoad && predicted >= *FlagAlertLoad
+}